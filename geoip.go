@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+var geoDB *maxminddb.Reader
+
+// geoRecord covers the fields we care about from both the GeoLite2-ASN
+// and GeoLite2-Country schemas. maxminddb leaves whatever a given
+// database doesn't provide at its zero value, so one struct works for
+// either.
+type geoRecord struct {
+	AutonomousSystemNumber       uint32 `maxminddb:"autonomous_system_number"`
+	AutonomousSystemOrganization string `maxminddb:"autonomous_system_organization"`
+	Country                      struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+// openGeoDB loads the MaxMind database given with -A. Callers should
+// treat a failure here as non-fatal: hop annotation is a nice-to-have,
+// not a requirement to run a trace.
+func openGeoDB(path string) error {
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return err
+	}
+	geoDB = db
+	return nil
+}
+
+// lookupGeo returns the ASN, AS organization and country for ip. All
+// values are zero when no GeoIP database was loaded or ip has no entry.
+func lookupGeo(ip net.IP) (asn uint32, asOrg string, country string) {
+	if geoDB == nil || ip == nil {
+		return 0, "", ""
+	}
+	var rec geoRecord
+	if err := geoDB.Lookup(ip, &rec); err != nil {
+		log.Printf("error looking up %s in GeoIP database: %s", ip, err)
+		return 0, "", ""
+	}
+	return rec.AutonomousSystemNumber, rec.AutonomousSystemOrganization, rec.Country.IsoCode
+}
+
+// formatGeoLabel renders pInfo's ASN/country annotation, e.g.
+// "[AS15169 GOOGLE, US]", or "" when nothing was found for the router.
+func formatGeoLabel(pInfo *probeInfo) string {
+	var asPart string
+	if pInfo.asn != 0 {
+		asPart = fmt.Sprintf("AS%d", pInfo.asn)
+		if pInfo.asOrg != "" {
+			asPart += " " + pInfo.asOrg
+		}
+	}
+	switch {
+	case asPart != "" && pInfo.country != "":
+		return fmt.Sprintf("[%s, %s]", asPart, pInfo.country)
+	case asPart != "":
+		return fmt.Sprintf("[%s]", asPart)
+	case pInfo.country != "":
+		return fmt.Sprintf("[%s]", pInfo.country)
+	default:
+		return ""
+	}
+}
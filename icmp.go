@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// pid identifies our own ICMP echo probes so we can tell them apart from
+// echo traffic generated by anything else running on the host.
+var pid = uint16(os.Getpid() & 0xffff)
+
+var icmpConnV4 *icmp.PacketConn
+var icmpConnV6 *icmp.PacketConn
+
+// icmpReady is closed once icmpConnV4/icmpConnV6 have been opened by
+// listenICMP, so sendProbeICMP never sees them nil.
+var icmpReady = make(chan struct{})
+
+// listenICMP opens the ICMPv4 and ICMPv6 listeners. Every probe response
+// they receive is routed to its waiting goroutine through pendingProbes.
+// The same sockets are reused by sendProbeICMP to send echo requests.
+// Callers must wait on icmpReady before starting probes.
+func listenICMP() {
+	var err error
+	icmpConnV4, err = icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		log.Fatalf("error listening for ICMP packets: %s", err)
+	}
+	icmpConnV6, err = icmp.ListenPacket("ip6:ipv6-icmp", "::")
+	if err != nil {
+		log.Fatalf("error listening for ICMPv6 packets: %s", err)
+	}
+	close(icmpReady)
+	go listenICMPv4()
+	go listenICMPv6()
+}
+
+func listenICMPv4() {
+	for {
+		buf := make([]byte, readBufSize)
+		n, peer, err := icmpConnV4.ReadFrom(buf)
+		if err != nil {
+			log.Printf("error reading data: %s", err)
+			continue
+		}
+		msg, err := icmp.ParseMessage(1, buf[:n]) // 1 == ICMP for IPv4
+		if err != nil {
+			log.Printf("error parsing ICMP message: %s", err)
+			continue
+		}
+		switch msg.Type {
+		case ipv4.ICMPTypeTimeExceeded, ipv4.ICMPTypeDestinationUnreachable:
+			key, ok := innerProbeKey(bodyData(msg.Body), false)
+			if !ok {
+				continue
+			}
+			pInfo := newProbeInfo(peer, int(msg.Type.(ipv4.ICMPType)), msg.Code)
+			if msg.Code == 4 { // fragmentation needed (RFC 1191)
+				if mtu, ok := nextHopMTU(buf[:n]); ok {
+					pInfo.mtu = mtu
+				}
+			}
+			dispatchProbe(key, pInfo)
+		case ipv4.ICMPTypeEchoReply:
+			echo, ok := msg.Body.(*icmp.Echo)
+			if !ok || uint16(echo.ID) != pid {
+				continue
+			}
+			dispatchProbe(uint16(echo.Seq), newProbeInfo(peer, arrivedType, arrivedCode))
+		}
+	}
+}
+
+func listenICMPv6() {
+	for {
+		buf := make([]byte, readBufSize)
+		n, peer, err := icmpConnV6.ReadFrom(buf)
+		if err != nil {
+			log.Printf("error reading data: %s", err)
+			continue
+		}
+		msg, err := icmp.ParseMessage(58, buf[:n]) // 58 == ICMP for IPv6
+		if err != nil {
+			log.Printf("error parsing ICMPv6 message: %s", err)
+			continue
+		}
+		switch msg.Type {
+		case ipv6.ICMPTypeTimeExceeded, ipv6.ICMPTypeDestinationUnreachable:
+			key, ok := innerProbeKey(bodyData(msg.Body), true)
+			if !ok {
+				continue
+			}
+			dispatchProbe(key, newProbeInfo(peer, int(msg.Type.(ipv6.ICMPType)), msg.Code))
+		case ipv6.ICMPTypeEchoReply:
+			echo, ok := msg.Body.(*icmp.Echo)
+			if !ok || uint16(echo.ID) != pid {
+				continue
+			}
+			dispatchProbe(uint16(echo.Seq), newProbeInfo(peer, arrivedType, arrivedCode))
+		}
+	}
+}
+
+// sendProbeICMP sends an ICMP echo request identified by our pid and the
+// given sequence number, at the given TTL/hop limit, and waits for the
+// matching echo reply (destination reached) or the Time Exceeded sent by
+// an intermediate router.
+func sendProbeICMP(destIP net.IP, seq int, ttl int) hopResult {
+	respChan := registerProbe(uint16(seq))
+	defer unregisterProbe(uint16(seq))
+
+	msg := icmp.Message{
+		Code: 0,
+		Body: &icmp.Echo{ID: int(pid), Seq: seq, Data: []byte("rt")},
+	}
+	startTS := time.Now().UnixNano()
+	var err error
+	if destIP.To4() != nil {
+		msg.Type = ipv4.ICMPTypeEcho
+		wb, merr := msg.Marshal(nil)
+		if merr != nil {
+			log.Printf("error building icmp echo request: %s", merr)
+			return hopResult{timedOut: true}
+		}
+		_, err = icmpConnV4.IPv4PacketConn().WriteTo(wb, &ipv4.ControlMessage{TTL: ttl}, &net.IPAddr{IP: destIP})
+	} else {
+		msg.Type = ipv6.ICMPTypeEchoRequest
+		wb, merr := msg.Marshal(nil)
+		if merr != nil {
+			log.Printf("error building icmpv6 echo request: %s", merr)
+			return hopResult{timedOut: true}
+		}
+		_, err = icmpConnV6.IPv6PacketConn().WriteTo(wb, &ipv6.ControlMessage{HopLimit: ttl}, &net.IPAddr{IP: destIP})
+	}
+	if err != nil {
+		log.Printf("error sending data: %s", err)
+		return hopResult{timedOut: true}
+	}
+
+	timer := time.NewTimer(probeTimeout * time.Second)
+	defer timer.Stop()
+	select {
+	case pInfo := <-respChan:
+		resolveRouterName(pInfo)
+		return hopResult{rtt: time.Duration(time.Now().UnixNano() - startTS), info: pInfo}
+	case <-timer.C:
+		return hopResult{timedOut: true}
+	}
+}
+
+// bodyData returns the raw invoking-datagram bytes (the inner IP header
+// plus the first 8 bytes of the transport header) carried by a Time
+// Exceeded or Destination Unreachable message.
+func bodyData(body icmp.MessageBody) []byte {
+	switch b := body.(type) {
+	case *icmp.TimeExceeded:
+		return b.Data
+	case *icmp.DstUnreach:
+		return b.Data
+	}
+	return nil
+}
+
+// innerProbeKey pulls the value that correlates an ICMP error back to
+// the probe that caused it out of the invoking datagram. For TCP and
+// ICMP echo probes that's the source port/sequence number we chose
+// ourselves; for UDP it's the destination port, since sendProbeUDP keys
+// on that instead of its ephemeral source port (see sendProbeUDP). All
+// of them live at a fixed offset past the inner IP header.
+func innerProbeKey(data []byte, isV6 bool) (uint16, bool) {
+	ipHeaderLen := 20
+	protoOff := 9
+	if isV6 {
+		ipHeaderLen = 40
+		protoOff = 6
+	}
+	if len(data) <= protoOff {
+		return 0, false
+	}
+	switch data[protoOff] {
+	case 17: // UDP: destination port is bytes 2-3 of the header
+		if len(data) < ipHeaderLen+4 {
+			return 0, false
+		}
+		return binary.BigEndian.Uint16(data[ipHeaderLen+2 : ipHeaderLen+4]), true
+	case 6: // TCP: source port is the first two bytes of the header
+		if len(data) < ipHeaderLen+2 {
+			return 0, false
+		}
+		return binary.BigEndian.Uint16(data[ipHeaderLen : ipHeaderLen+2]), true
+	case 1, 58: // ICMP, ICMPv6: sequence number is bytes 6-7 of the echo header
+		if len(data) < ipHeaderLen+8 {
+			return 0, false
+		}
+		return binary.BigEndian.Uint16(data[ipHeaderLen+6 : ipHeaderLen+8]), true
+	default:
+		return 0, false
+	}
+}
+
+// newProbeInfo builds a probeInfo from the peer address and ICMP
+// type/code of a probe response, common to both the IPv4 and IPv6
+// listeners. routerName is left unresolved here; resolveRouterName
+// fills it in later, off the shared listener goroutine.
+func newProbeInfo(peer net.Addr, icmpType int, icmpCode int) *probeInfo {
+	routerIP := peer.(*net.IPAddr).IP
+	asn, asOrg, country := lookupGeo(routerIP)
+	return &probeInfo{
+		routerIP: routerIP,
+		icmpType: icmpType,
+		icmpCode: icmpCode,
+		asn:      asn,
+		asOrg:    asOrg,
+		country:  country,
+	}
+}
+
+// resolveRouterName looks up pInfo.routerIP's reverse DNS name. It's
+// called from each probe's own goroutine after its response has already
+// been dispatched, so a slow or unanswered PTR lookup delays only that
+// probe's result instead of stalling the shared listener that every
+// other in-flight probe is waiting on.
+func resolveRouterName(pInfo *probeInfo) {
+	names, _ := net.LookupAddr(pInfo.routerIP.String())
+	if len(names) > 0 {
+		pInfo.routerName = names[0]
+	}
+}
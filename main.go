@@ -6,10 +6,12 @@ import (
 	"log"
 	"net"
 	"os"
+	"sync"
 	"syscall"
 	"time"
 
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 var debugF = flag.Bool("d", false, "Enable socket level debugging (if supported)")
@@ -17,11 +19,23 @@ var ttlF = flag.Int("f", 1, "Specify with what TTL to start. Defaults to 1")
 var hopsF = flag.Int("m", 30, "Specify the maximum number of hops (max time-to-live value) the program will probe. The default is 30")
 var portF = flag.Int("p", 34500, "Specify the destination port to use. This number will be incremented by each probe")
 var probesF = flag.Int("q", 3, "Sets the number of probe packets per hop. The default number is 3")
+var ip4F = flag.Bool("4", false, "Use IPv4 for this trace")
+var ip6F = flag.Bool("6", false, "Use IPv6 for this trace")
+var protoF = flag.String("P", "udp", "Specify the probe protocol to use: udp, icmp or tcp. Defaults to udp")
+var tcpPortF = flag.Int("t", 80, "Specify the destination port to use in TCP probe mode. The default is 80")
+var geoipF = flag.String("A", "", "Specify a MaxMind .mmdb file to annotate each hop with its ASN and country")
+var jsonF = flag.Bool("json", false, "Emit machine-readable JSON instead of the human-readable report")
+var mtuF = flag.Bool("M", false, "Enable Path MTU Discovery mode (IPv4 UDP only); relies on routers reporting Next-Hop MTU (RFC 1191) and will not find the bottleneck MTU on paths where they don't")
 
 const (
 	dataBytesLen = 16   // amount of data sent on the UDP packet
 	readBufSize  = 1024 // buffer size when reading data from the ICMP packet
 	probeTimeout = 5    // amount of seconds to wait before the response for a probe times out
+
+	// maxInFlightProbes bounds how many probes may be in flight (and how
+	// many sockets/goroutines that implies) at once, so a large -m/-q
+	// doesn't exhaust file descriptors.
+	maxInFlightProbes = 256
 )
 
 func main() {
@@ -29,7 +43,7 @@ func main() {
 	log.SetFlags(0)
 	flag.Parse()
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "usage of rt: [-d -f -m -p -q] host\n")
+		fmt.Fprintf(os.Stderr, "usage of rt: [-d -f -m -p -q -4 -6 -P -t -A -json -M] host\n")
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
@@ -41,6 +55,32 @@ func main() {
 		log.Printf("only 1 destination must be specified\n")
 		flag.Usage()
 	}
+	if *ip4F && *ip6F {
+		log.Printf("only one of -4 or -6 may be specified\n")
+		flag.Usage()
+	}
+	if *ip6F && *protoF == "tcp" {
+		log.Printf("-P tcp only supports IPv4, it cannot be combined with -6\n")
+		flag.Usage()
+	}
+	switch *protoF {
+	case "udp", "icmp", "tcp":
+	default:
+		log.Printf("invalid probe protocol %q, must be one of udp, icmp, tcp\n", *protoF)
+		flag.Usage()
+	}
+	if *mtuF && *protoF != "udp" {
+		log.Printf("-M (Path MTU Discovery) only supports -P udp\n")
+		flag.Usage()
+	}
+	if *mtuF && *ip6F {
+		log.Printf("-M (Path MTU Discovery) only supports IPv4, it cannot be combined with -6\n")
+		flag.Usage()
+	}
+	if *ttlF > *hopsF {
+		log.Printf("-f (%d) must not be greater than -m (%d)\n", *ttlF, *hopsF)
+		flag.Usage()
+	}
 	// TODO: validate the port number, it should be greater than 30,000
 	// TODO: make changes to use the process id for the initial port number
 	//       in case there's more than 1 traceroute program running
@@ -57,15 +97,26 @@ func main() {
 	if err != nil {
 		log.Fatalf("IP address not found: %s", err)
 	}
-	printStart(destination, destinationIP)
+	if *geoipF != "" {
+		if err := openGeoDB(*geoipF); err != nil {
+			log.Printf("warning: could not open GeoIP database %s: %s", *geoipF, err)
+		}
+	}
+	rep := newReporter()
+	rep.start(destination, destinationIP)
 	go listenICMP()
-	startTrace(destinationIP)
+	<-icmpReady
+	if *protoF == "tcp" {
+		go listenTCP(destinationIP)
+		<-tcpReady
+	}
+	startTrace(destinationIP, rep)
+	rep.finish()
 }
 
 type tracePacket struct {
-	seqNum int32
-	ttl    int32
-	ts     int64
+	ttl int32
+	ts  int64
 }
 
 type probeInfo struct {
@@ -73,85 +124,175 @@ type probeInfo struct {
 	routerName string
 	icmpType   int
 	icmpCode   int
+	asn        uint32
+	asOrg      string
+	country    string
+	mtu        int // Next-Hop MTU from an ICMPv4 fragmentation-needed reply; 0 if none
+}
+
+// hopResult holds the outcome of a single probe sent for a hop.
+type hopResult struct {
+	rtt      time.Duration
+	info     *probeInfo
+	timedOut bool
 }
 
-var probChan chan *probeInfo
+// startTrace fires every probe for every TTL up front instead of waiting
+// probeTimeout seconds between each one, so a trace that times out on
+// every hop still finishes in ~probeTimeout seconds instead of
+// probeTimeout*hops*probes. Probes are correlated to their response by
+// a per-probe identifier (see pendingProbes and sendProbe), and rows are
+// printed in TTL order as soon as all of a row's probes complete.
+func startTrace(destIP net.IP, rep reporter) {
+	port := *portF
+	numHops := *hopsF - *ttlF + 1
+	rows := make([][]hopResult, numHops)
+	rowDone := make([]chan struct{}, numHops)
+
+	var mu sync.Mutex
+	reached := -1 // index into rows of the first hop that reached the destination
 
-func listenICMP() {
-	laddr := net.IPAddr{
-		IP: nil,
+	// sem bounds how many probes are in flight at once; the dispatch loop
+	// below blocks on it once full, sliding the window forward as probes
+	// complete instead of opening every socket up front.
+	sem := make(chan struct{}, maxInFlightProbes)
+
+	for i, ttl := 0, *ttlF; i < numHops; i, ttl = i+1, ttl+1 {
+		rows[i] = make([]hopResult, *probesF)
+		rowDone[i] = make(chan struct{})
+
+		var rowWG sync.WaitGroup
+		rowWG.Add(*probesF)
+		for pro := 0; pro < *probesF; pro++ {
+			sem <- struct{}{}
+			go func(i, ttl, pro, port int) {
+				defer rowWG.Done()
+				defer func() { <-sem }()
+				res := sendProbe(destIP, port, ttl)
+				rows[i][pro] = res
+				if !res.timedOut && isPortUnreachable(res.info) {
+					mu.Lock()
+					if reached == -1 || i < reached {
+						reached = i
+					}
+					mu.Unlock()
+				}
+			}(i, ttl, pro, port)
+			port++
+		}
+		go func(done chan struct{}, wg *sync.WaitGroup) {
+			wg.Wait()
+			close(done)
+		}(rowDone[i], &rowWG)
 	}
-	conn, err := net.ListenIP("ip4:1", &laddr)
+
+	for i, ttl := 0, *ttlF; i < numHops; i, ttl = i+1, ttl+1 {
+		<-rowDone[i]
+		mu.Lock()
+		stop := reached != -1 && i >= reached
+		mu.Unlock()
+		rep.reportHop(ttl, rows[i], stop)
+		if stop {
+			break
+		}
+	}
+}
+
+// sendProbe sends a single probe with the given TTL using the protocol
+// selected by -P, and waits up to probeTimeout for its response. id is
+// the probe's correlation identifier: a UDP destination port, an ICMP
+// echo sequence number, or a TCP source port, depending on the protocol.
+func sendProbe(destIP net.IP, id int, ttl int) hopResult {
+	switch *protoF {
+	case "icmp":
+		return sendProbeICMP(destIP, id, ttl)
+	case "tcp":
+		return sendProbeTCP(destIP, id, ttl)
+	default:
+		return sendProbeUDP(destIP, id, ttl)
+	}
+}
+
+// sendProbeUDP sends a single UDP probe with the given TTL and waits up
+// to probeTimeout for its correlated ICMP response.
+func sendProbeUDP(destIP net.IP, port int, ttl int) hopResult {
+	udpConn, err := connectUDP(destIP, port, ttl)
 	if err != nil {
-		log.Fatalf("error listening for ICPMP packets: %s", err)
-	}
-	probChan = make(chan *probeInfo)
-	for {
-		buf := make([]byte, readBufSize)
-		_, err = conn.Read(buf)
-		if err != nil {
-			log.Printf("error reading data: %s", err)
-			continue
+		log.Printf("error connecting: %s", err)
+		return hopResult{timedOut: true}
+	}
+	defer udpConn.Close()
+	if *debugF {
+		if sc, ok := udpConn.(syscall.Conn); ok {
+			setSocketDebugOption(sc) // ignoring any errors
 		}
-		pInfo := newProbeInfo(buf)
-		probChan <- pInfo
+	}
+
+	// Correlate by the destination port we chose (unique for the life of
+	// the trace, see startTrace) rather than the ephemeral local source
+	// port: the OS is free to hand that source port to a new socket the
+	// moment udpConn.Close() returns, and a late ICMP error for this probe
+	// would then be misdelivered to whichever probe reused it.
+	probeID := uint16(port)
+	respChan := registerProbe(probeID)
+	defer unregisterProbe(probeID)
+
+	d := tracePacket{
+		ttl: int32(ttl),
+		ts:  time.Now().UnixNano(),
+	}
+	startTS := d.ts
+	if _, err := udpConn.Write(probePayload(&d)); err != nil {
+		log.Printf("error sending data: %s", err)
+		return hopResult{timedOut: true}
+	}
+
+	timer := time.NewTimer(probeTimeout * time.Second)
+	defer timer.Stop()
+	select {
+	case pInfo := <-respChan:
+		resolveRouterName(pInfo)
+		return hopResult{rtt: time.Duration(time.Now().UnixNano() - startTS), info: pInfo}
+	case <-timer.C:
+		return hopResult{timedOut: true}
 	}
 }
 
-func startTrace(destIP net.IP) {
-	port := *portF
-	var seqNum int
-	var done bool
-	for ttl := *ttlF; ttl <= *hopsF; ttl++ {
-		if done {
-			break
+// printHop prints a single traceroute row: the TTL, the router that
+// answered the first successful probe, and the RTT (or "*") of each
+// probe in the row.
+func printHop(ttl int, hop []hopResult) {
+	fmt.Printf("%d ", ttl)
+	printedRouter := false
+	for _, r := range hop {
+		if r.timedOut {
+			fmt.Printf("* ")
+			continue
 		}
-		fmt.Printf("%d ", ttl)
-		for pro := 0; pro < *probesF; pro++ {
-			udpConn, err := connectUDP(destIP, port, ttl)
-			if err != nil {
-				log.Printf("error connecting: %s", err)
-				continue
-			}
-			if *debugF {
-				setSocketDebugOption(udpConn) // ignoring any errors
-			}
-			seqNum++
-			port++
-			d := tracePacket{
-				seqNum: int32(seqNum),
-				ttl:    int32(ttl),
-				ts:     time.Now().UnixNano(),
-			}
-			startTS := d.ts
-			_, err = udpConn.Write(getTracePacketData(&d))
-			if err != nil {
-				log.Printf("error sending data: %s", err)
-				continue
-			}
-			timer := time.NewTimer(probeTimeout * time.Second)
-			var pInfo *probeInfo
-			select {
-			case pInfo = <-probChan:
-				timer.Stop()
-			case <-timer.C:
-				fmt.Printf("* ")
-				continue // continue to the next probe
-			}
-			endTS := time.Now().UnixNano()
-			if pro == 0 {
-				printRouterIP(pInfo)
-			}
-			fmt.Printf("%.3f ms   ", float64(endTS-startTS)/1000000.00)
-			if isPortUnreachable(pInfo) {
-				done = true
-			}
+		if !printedRouter {
+			printRouterIP(r.info)
+			printedRouter = true
 		}
-		fmt.Println()
+		fmt.Printf("%.3f ms", float64(r.rtt)/float64(time.Millisecond))
+		if r.info.mtu > 0 {
+			fmt.Printf(" (mtu %d)", r.info.mtu)
+		}
+		fmt.Printf("   ")
+	}
+	fmt.Println()
+}
+
+// connectUDP dials the destination over UDP4 or UDP6, depending on the
+// family of destIP, and sets the hop limit (TTL for IPv4, Hop Limit for
+// IPv6) for the probe.
+func connectUDP(destIP net.IP, port int, ttl int) (net.Conn, error) {
+	if destIP.To4() != nil {
+		return connectUDP4(destIP, port, ttl)
 	}
+	return connectUDP6(destIP, port, ttl)
 }
 
-func connectUDP(destIP net.IP, port int, ttl int) (*net.UDPConn, error) {
+func connectUDP4(destIP net.IP, port int, ttl int) (net.Conn, error) {
 	raddr := net.UDPAddr{
 		IP:   destIP,
 		Port: port,
@@ -165,25 +306,29 @@ func connectUDP(destIP net.IP, port int, ttl int) (*net.UDPConn, error) {
 	if err != nil {
 		return nil, err
 	}
+	if *mtuF {
+		if err := setDontFragment(udpConn); err != nil {
+			log.Printf("error setting the don't-fragment bit: %s", err)
+		}
+	}
 	return udpConn, nil
 }
 
-func newProbeInfo(buf []byte) *probeInfo {
-	var routerName string
-	routerIP := net.IPv4(buf[12], buf[13], buf[14], buf[15])
-	icmpType := int(buf[20])
-	icmpCode := int(buf[21])
-
-	names, _ := net.LookupAddr(routerIP.String())
-	if len(names) > 0 {
-		routerName = names[0]
+func connectUDP6(destIP net.IP, port int, ttl int) (net.Conn, error) {
+	raddr := net.UDPAddr{
+		IP:   destIP,
+		Port: port,
 	}
-	return &probeInfo{
-		routerIP:   routerIP,
-		routerName: routerName,
-		icmpType:   icmpType,
-		icmpCode:   icmpCode,
+	udpConn, err := net.DialUDP("udp6", nil, &raddr)
+	if err != nil {
+		return nil, err
 	}
+	nconn := ipv6.NewConn(udpConn)
+	err = nconn.SetHopLimit(ttl)
+	if err != nil {
+		return nil, err
+	}
+	return udpConn, nil
 }
 
 func printRouterIP(pInfo *probeInfo) {
@@ -194,14 +339,21 @@ func printRouterIP(pInfo *probeInfo) {
 		fmt.Printf("%s", routerAddr)
 	}
 	fmt.Printf(" (%s)", routerAddr)
+	if label := formatGeoLabel(pInfo); label != "" {
+		fmt.Printf(" %s", label)
+	}
 	fmt.Printf("  ")
 }
 
 func isPortUnreachable(pInfo *probeInfo) bool {
-	if pInfo.icmpType == 3 && pInfo.icmpCode == 3 {
+	if pInfo.icmpType == arrivedType && pInfo.icmpCode == arrivedCode {
 		return true
 	}
-	return false
+	if pInfo.routerIP.To4() != nil {
+		return pInfo.icmpType == 3 && pInfo.icmpCode == 3
+	}
+	// ICMPv6 destination unreachable / port unreachable
+	return pInfo.icmpType == 1 && pInfo.icmpCode == 4
 }
 
 func getTracePacketData(data *tracePacket) []byte {
@@ -226,17 +378,33 @@ func printStart(destination string, destinationIP net.IP) {
 	fmt.Printf(" %d hops max, %d byte packets\n", *hopsF, dataBytesLen)
 }
 
+// getIPAddr picks a destination address out of addrs, honoring the -4
+// and -6 flags. When neither flag is given, the first IPv4 address wins.
 func getIPAddr(addrs []string) (net.IP, error) {
 	for _, a := range addrs {
 		ip := net.ParseIP(a)
-		if ip != nil && ip.To4() != nil {
-			return ip, nil
+		if ip == nil {
+			continue
+		}
+		switch {
+		case *ip6F:
+			if ip.To4() == nil {
+				return ip, nil
+			}
+		case *ip4F:
+			if ip.To4() != nil {
+				return ip, nil
+			}
+		default:
+			if ip.To4() != nil {
+				return ip, nil
+			}
 		}
 	}
 	return nil, fmt.Errorf("address not found")
 }
 
-func setSocketDebugOption(conn *net.UDPConn) error {
+func setSocketDebugOption(conn syscall.Conn) error {
 	rc, err := conn.SyscallConn()
 	if err != nil {
 		return err
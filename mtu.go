@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/binary"
+	"syscall"
+)
+
+// mtuProbeSize is a full Ethernet frame (1500 bytes) minus the IPv4 and
+// UDP headers, used as the padded payload size in -M mode.
+const mtuProbeSize = 1472
+
+// probePayload returns the bytes to send for a probe. In -M mode the
+// payload is padded to mtuProbeSize so, combined with the Don't
+// Fragment bit, a router that can't forward it whole must reply with
+// "fragmentation needed" instead of silently fragmenting it.
+func probePayload(d *tracePacket) []byte {
+	base := getTracePacketData(d)
+	if !*mtuF {
+		return base
+	}
+	payload := make([]byte, mtuProbeSize)
+	copy(payload, base)
+	return payload
+}
+
+// setDontFragment sets IP_PMTUDISC_DO on conn so outgoing datagrams
+// carry the IPv4 Don't Fragment bit.
+func setDontFragment(conn syscall.Conn) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return rc.Control(func(fd uintptr) {
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO)
+	})
+}
+
+// nextHopMTU reads the RFC 1191 Next-Hop MTU field from a "fragmentation
+// needed" (type 3, code 4) message: a 16-bit field at bytes 6-7.
+func nextHopMTU(raw []byte) (int, bool) {
+	if len(raw) < 8 {
+		return 0, false
+	}
+	return int(binary.BigEndian.Uint16(raw[6:8])), true
+}
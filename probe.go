@@ -0,0 +1,41 @@
+package main
+
+import "sync"
+
+// arrivedType/arrivedCode mark a probe response with no real ICMP
+// type/code (an echo reply, or a TCP SYN-ACK/RST).
+const (
+	arrivedType = -1
+	arrivedCode = -1
+)
+
+// pendingProbes correlates in-flight probes with their responses, keyed
+// by the UDP destination port, TCP source port or ICMP sequence number
+// the probe used.
+var pendingProbes sync.Map // map[uint16]chan *probeInfo
+
+// registerProbe allocates the channel a probe's response is delivered
+// on, keyed by its correlation id.
+func registerProbe(port uint16) chan *probeInfo {
+	ch := make(chan *probeInfo, 1)
+	pendingProbes.Store(port, ch)
+	return ch
+}
+
+// unregisterProbe removes a probe's channel once answered or timed out.
+func unregisterProbe(port uint16) {
+	pendingProbes.Delete(port)
+}
+
+// dispatchProbe hands a response to the goroutine waiting on it. Unknown
+// or already-timed-out ids are dropped; the send never blocks.
+func dispatchProbe(port uint16, pInfo *probeInfo) {
+	v, ok := pendingProbes.Load(port)
+	if !ok {
+		return
+	}
+	select {
+	case v.(chan *probeInfo) <- pInfo:
+	default:
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// reporter formats and emits the outcome of a trace. Adding a new output
+// format (Prometheus textfile, an NDJSON stream, ...) means adding a new
+// implementation here, not touching startTrace.
+type reporter interface {
+	start(destination string, destinationIP net.IP)
+	reportHop(ttl int, hop []hopResult, done bool)
+	finish()
+}
+
+func newReporter() reporter {
+	if *jsonF {
+		return &jsonReporter{}
+	}
+	return &textReporter{}
+}
+
+// textReporter is the classic human-readable traceroute report.
+type textReporter struct {
+	minMTU int // smallest Next-Hop MTU seen on the path; 0 if none
+}
+
+func (r *textReporter) start(destination string, destinationIP net.IP) {
+	printStart(destination, destinationIP)
+}
+
+func (r *textReporter) reportHop(ttl int, hop []hopResult, done bool) {
+	printHop(ttl, hop)
+	for _, res := range hop {
+		if res.timedOut || res.info.mtu == 0 {
+			continue
+		}
+		if r.minMTU == 0 || res.info.mtu < r.minMTU {
+			r.minMTU = res.info.mtu
+		}
+	}
+}
+
+func (r *textReporter) finish() {
+	if *mtuF && r.minMTU > 0 {
+		fmt.Printf("Path MTU: %d bytes\n", r.minMTU)
+	}
+}
+
+// probeReport is the JSON representation of a single probe's outcome.
+// ICMPType/ICMPCode are nil (omitted as "icmp_type"/"icmp_code") for a
+// probe that arrived via an ICMP echo reply or a TCP SYN-ACK/RST, since
+// those don't carry a real ICMP type/code -- see arrivedType/arrivedCode.
+type probeReport struct {
+	RTTMs      float64 `json:"rtt_ms,omitempty"`
+	RouterIP   string  `json:"router_ip,omitempty"`
+	RouterName string  `json:"router_name,omitempty"`
+	ICMPType   *int    `json:"icmp_type,omitempty"`
+	ICMPCode   *int    `json:"icmp_code,omitempty"`
+	ASN        uint32  `json:"asn,omitempty"`
+	MTU        int     `json:"mtu,omitempty"`
+	TimedOut   bool    `json:"timed_out"`
+}
+
+// hopReport is the JSON representation of a completed hop.
+type hopReport struct {
+	TTL    int           `json:"ttl"`
+	Probes []probeReport `json:"probes"`
+	Done   bool          `json:"done"`
+}
+
+// jsonReporter buffers each completed hop and prints them as a single
+// JSON array once the trace finishes, for embedding rt in monitoring
+// pipelines and web frontends.
+type jsonReporter struct {
+	hops []hopReport
+}
+
+func (r *jsonReporter) start(destination string, destinationIP net.IP) {}
+
+func (r *jsonReporter) reportHop(ttl int, hop []hopResult, done bool) {
+	hr := hopReport{TTL: ttl, Done: done, Probes: make([]probeReport, len(hop))}
+	for i, res := range hop {
+		if res.timedOut {
+			hr.Probes[i] = probeReport{TimedOut: true}
+			continue
+		}
+		pr := probeReport{
+			RTTMs:      float64(res.rtt) / float64(time.Millisecond),
+			RouterIP:   res.info.routerIP.String(),
+			RouterName: res.info.routerName,
+			ASN:        res.info.asn,
+			MTU:        res.info.mtu,
+		}
+		if res.info.icmpType != arrivedType || res.info.icmpCode != arrivedCode {
+			pr.ICMPType = &res.info.icmpType
+			pr.ICMPCode = &res.info.icmpCode
+		}
+		hr.Probes[i] = pr
+	}
+	r.hops = append(r.hops, hr)
+}
+
+func (r *jsonReporter) finish() {
+	b, err := json.Marshal(r.hops)
+	if err != nil {
+		log.Printf("error marshaling JSON output: %s", err)
+		return
+	}
+	fmt.Println(string(b))
+}
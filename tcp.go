@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+const tcpHeaderLen = 20 // no options
+
+// tcpReady is closed once listenTCP's socket is open, so a SYN-ACK/RST
+// arriving before the listener is scheduled isn't dropped on the floor.
+var tcpReady = make(chan struct{})
+
+// sendProbeTCP crafts a bare SYN segment to destIP:*tcpPortF from
+// srcPort, at the given TTL, and treats a SYN-ACK or RST from the
+// destination as having arrived -- the TCP equivalent of a UDP port
+// unreachable. Requires permission to open a raw IPv4 socket.
+func sendProbeTCP(destIP net.IP, srcPort int, ttl int) hopResult {
+	conn, err := net.DialIP("ip4:tcp", nil, &net.IPAddr{IP: destIP})
+	if err != nil {
+		log.Printf("error opening raw TCP socket: %s", err)
+		return hopResult{timedOut: true}
+	}
+	defer conn.Close()
+	if err := ipv4.NewConn(conn).SetTTL(ttl); err != nil {
+		log.Printf("error setting ttl: %s", err)
+		return hopResult{timedOut: true}
+	}
+
+	respChan := registerProbe(uint16(srcPort))
+	defer unregisterProbe(uint16(srcPort))
+
+	var srcIP net.IP
+	if la, ok := conn.LocalAddr().(*net.IPAddr); ok {
+		srcIP = la.IP
+	}
+	seg := buildSYN(uint16(srcPort), uint16(*tcpPortF), srcIP, destIP)
+
+	startTS := time.Now().UnixNano()
+	if _, err := conn.Write(seg); err != nil {
+		log.Printf("error sending data: %s", err)
+		return hopResult{timedOut: true}
+	}
+
+	timer := time.NewTimer(probeTimeout * time.Second)
+	defer timer.Stop()
+	select {
+	case pInfo := <-respChan:
+		resolveRouterName(pInfo)
+		return hopResult{rtt: time.Duration(time.Now().UnixNano() - startTS), info: pInfo}
+	case <-timer.C:
+		return hopResult{timedOut: true}
+	}
+}
+
+// listenTCP watches for SYN-ACK or RST segments answering our probes.
+// Unlike UDP/ICMP, a successful TCP probe never reaches listenICMP: the
+// destination replies over TCP, not ICMP, so it needs its own listener.
+// A raw ip4:tcp socket receives every inbound TCP segment on the host, so
+// destIP is used to ignore segments from anything other than the traced
+// destination -- otherwise unrelated TCP traffic sharing our probe's
+// source port could be mistaken for the destination having been reached.
+// Callers must wait on tcpReady before starting probes.
+func listenTCP(destIP net.IP) {
+	conn, err := net.ListenIP("ip4:tcp", &net.IPAddr{})
+	if err != nil {
+		log.Fatalf("error listening for TCP packets: %s", err)
+	}
+	close(tcpReady)
+	for {
+		buf := make([]byte, readBufSize)
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Printf("error reading data: %s", err)
+			continue
+		}
+		peerAddr, ok := peer.(*net.IPAddr)
+		if !ok || !peerAddr.IP.Equal(destIP) {
+			continue
+		}
+		seg := buf[:n]
+		if len(seg) < tcpHeaderLen {
+			continue
+		}
+		dstPort := binary.BigEndian.Uint16(seg[2:4])
+		flags := seg[13]
+		const synAck = 0x12 // SYN+ACK
+		const rst = 0x04
+		if flags&synAck != synAck && flags&rst != rst {
+			continue
+		}
+		dispatchProbe(dstPort, newProbeInfo(peer, arrivedType, arrivedCode))
+	}
+}
+
+// buildSYN assembles a bare TCP SYN segment with a valid checksum.
+func buildSYN(srcPort, dstPort uint16, srcIP, dstIP net.IP) []byte {
+	seg := make([]byte, tcpHeaderLen)
+	binary.BigEndian.PutUint16(seg[0:2], srcPort)
+	binary.BigEndian.PutUint16(seg[2:4], dstPort)
+	binary.BigEndian.PutUint32(seg[4:8], 0)  // sequence number
+	binary.BigEndian.PutUint32(seg[8:12], 0) // ack number
+	seg[12] = 5 << 4                         // data offset: 5 words, no options
+	seg[13] = 0x02                           // SYN
+	binary.BigEndian.PutUint16(seg[14:16], 65535)
+	binary.BigEndian.PutUint16(seg[18:20], 0) // urgent pointer
+
+	binary.BigEndian.PutUint16(seg[16:18], tcpChecksum(srcIP, dstIP, seg))
+	return seg
+}
+
+// tcpChecksum computes the TCP checksum over the IPv4 pseudo-header and
+// the segment itself, per RFC 793.
+func tcpChecksum(srcIP, dstIP net.IP, seg []byte) uint16 {
+	pseudo := make([]byte, 12+len(seg))
+	copy(pseudo[0:4], srcIP.To4())
+	copy(pseudo[4:8], dstIP.To4())
+	pseudo[9] = 6 // TCP protocol number
+	binary.BigEndian.PutUint16(pseudo[10:12], uint16(len(seg)))
+	copy(pseudo[12:], seg)
+
+	var sum uint32
+	for i := 0; i+1 < len(pseudo); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(pseudo[i : i+2]))
+	}
+	if len(pseudo)%2 == 1 {
+		sum += uint32(pseudo[len(pseudo)-1]) << 8
+	}
+	for sum>>16 > 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}